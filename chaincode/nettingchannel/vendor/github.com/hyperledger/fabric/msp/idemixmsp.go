@@ -8,7 +8,13 @@ package msp
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -25,24 +31,289 @@ const (
 
 	// AttributeNameRole is the attribute name of the Role attribute
 	AttributeNameRole = "Role"
+
+	// AttributeNameEnrollmentId is the attribute name of the enrollment ID attribute
+	AttributeNameEnrollmentId = "EnrollmentID"
+
+	// AttributeNameRevocationHandle is the attribute name of the revocation handle attribute
+	AttributeNameRevocationHandle = "RevocationHandle"
+)
+
+// discloseFlags is passed to the idemix signing and verification routines
+// for the plain Sign/Verify pair. It discloses OU and Role, while keeping
+// the enrollment ID and revocation handle hidden so that unlinkability is
+// preserved. It covers exactly the four fixed attributes; any additional,
+// user-declared attributes are always hidden under Sign/Verify and are only
+// selectively revealed via SignWithDisclosure.
+var discloseFlags = []byte{1, 1, 0, 0}
+
+// rhIndex and eidIndex are the fixed positions of the revocation handle and
+// enrollment ID attributes within the credential's attribute vector.
+// numFixedAttrs is the number of attributes every idemix credential carries
+// before any user-declared, schema-driven attributes.
+const (
+	eidIndex      = 2
+	rhIndex       = 3
+	numFixedAttrs = 4
 )
 
-// discloseFlags will be passed to the idemix signing and verification routines.
-// It informs idemix to disclose both attributes (OU and Role) when signing.
-var discloseFlags = []byte{1, 1}
+// defaultCRIFreshnessWindow is the freshness window applied when the MSP
+// config doesn't declare conf.CriFreshnessSeconds: an epoch older than one
+// day is treated as stale.
+const defaultCRIFreshnessWindow = 24 * time.Hour
 
 type idemixmsp struct {
 	ipk    *idemix.IssuerPublicKey
 	rng    *amcl.RAND
 	signer *idemixSigningIdentity
 	name   string
+
+	// revocationPK is the public key used to verify the issuer's signature
+	// over the Credential Revocation Information (CRI).
+	revocationPK *ecdsa.PublicKey
+	// cri is the most recently installed Credential Revocation Information.
+	// It lists the revocation handles that are revoked as of cri.Epoch.
+	cri *m.CredentialRevocationInformation
+	// criFreshnessWindow bounds how long an installed CRI may be trusted
+	// after its epoch: Sign, Verify, and Validate of a signing identity
+	// fail against a CRI whose epoch is older than this window, so a stale
+	// CRI that predates a revocation can't be relied on indefinitely.
+	// Validate of a plain (public) idemixidentity does not check the CRI.
+	// It defaults to defaultCRIFreshnessWindow when the config doesn't
+	// specify one.
+	criFreshnessWindow time.Duration
+
+	// wallet holds additional (sk, Nym, RandNym, Cred, role, OU) tuples,
+	// keyed by IdentityIdentifier.Id, beyond the single default signer.
+	wallet map[string]*idemixWalletEntry
+	// walletDir is the MSP config directory under which wallet entries are
+	// persisted, analogous to how X.509 MSPs load keystore/ and signcerts/.
+	// It is empty when the wallet is in-memory only.
+	walletDir string
+
+	// auditorPK is the optional ElGamal public key of a designated auditor.
+	// When set, Sign attaches a ZK-provable encryption of the signer's
+	// enrollment ID that only the holder of the matching secret key can
+	// decrypt, via AuditorDecrypt.
+	auditorPK *amcl.ECP
+
+	// provider performs the underlying idemix cryptographic operations.
+	// It defaults to a software implementation but can be swapped for one
+	// backed by an HSM, analogous to how the X.509 MSP delegates to BCCSP.
+	provider IdemixProvider
+
+	// attributeNames is the full, ordered attribute schema for this MSP's
+	// credentials: the four fixed attributes (OU, Role, EnrollmentId,
+	// RevocationHandle) followed by zero or more additional, user-declared
+	// attribute names, in the same order as ipk.AttributeNames.
+	attributeNames []string
+}
+
+// IdemixProvider abstracts the idemix cryptographic primitives used by
+// idemixmsp, analogous to how the X.509 MSP delegates key-handling and
+// signing operations to BCCSP. This indirection lets the sensitive,
+// long-lived Idemix user secrets (Sk and RandNym) be protected by a
+// hardware module instead of living as plain amcl.BIG values in process
+// memory.
+type IdemixProvider interface {
+	// GetRand returns a fresh PRNG seeded from the provider's randomness
+	// source.
+	GetRand() (*amcl.RAND, error)
+
+	// MakeNym derives a fresh pseudonym, and the randomness used to blind
+	// it, for the secret key sk under the issuer public key ipk.
+	MakeNym(sk *amcl.BIG, ipk *idemix.IssuerPublicKey, rng *amcl.RAND) (*amcl.ECP, *amcl.BIG, error)
+
+	// NewSignature produces an idemix signature over msg that discloses the
+	// attributes indicated by disclosure, proving Nym was derived from sk
+	// and that the revocation handle attribute at rhIndex does not appear
+	// in cri's revoked set.
+	NewSignature(cred *idemix.Credential, sk *amcl.BIG, Nym *amcl.ECP, RandNym *amcl.BIG, ipk *idemix.IssuerPublicKey, disclosure []byte, msg []byte, rhIndex int, cri *m.CredentialRevocationInformation, rng *amcl.RAND) (*idemix.Signature, error)
+
+	// VerifyCredential checks that cred was correctly issued for sk under
+	// ipk.
+	VerifyCredential(cred *idemix.Credential, sk *amcl.BIG, ipk *idemix.IssuerPublicKey) error
+
+	// HashModOrder hashes data down to a scalar modulo the curve's group
+	// order.
+	HashModOrder(data []byte) *amcl.BIG
+
+	// BigToBytes serializes a scalar to its canonical byte representation.
+	BigToBytes(b *amcl.BIG) []byte
+}
+
+// softwareIdemixProvider is the default IdemixProvider: it performs every
+// operation in process memory via the idemix package, matching the
+// behavior idemixmsp had before the provider indirection was introduced.
+type softwareIdemixProvider struct{}
+
+// NewIdemixProvider returns the default, software-only IdemixProvider.
+func NewIdemixProvider() IdemixProvider {
+	return &softwareIdemixProvider{}
+}
+
+func (p *softwareIdemixProvider) GetRand() (*amcl.RAND, error) {
+	return idemix.GetRand()
+}
+
+func (p *softwareIdemixProvider) MakeNym(sk *amcl.BIG, ipk *idemix.IssuerPublicKey, rng *amcl.RAND) (*amcl.ECP, *amcl.BIG, error) {
+	Nym, RandNym := idemix.MakeNym(sk, ipk, rng)
+	return Nym, RandNym, nil
+}
+
+func (p *softwareIdemixProvider) NewSignature(cred *idemix.Credential, sk *amcl.BIG, Nym *amcl.ECP, RandNym *amcl.BIG, ipk *idemix.IssuerPublicKey, disclosure []byte, msg []byte, rhIndex int, cri *m.CredentialRevocationInformation, rng *amcl.RAND) (*idemix.Signature, error) {
+	return idemix.NewSignature(cred, sk, Nym, RandNym, ipk, disclosure, msg, rhIndex, cri, rng), nil
+}
+
+func (p *softwareIdemixProvider) VerifyCredential(cred *idemix.Credential, sk *amcl.BIG, ipk *idemix.IssuerPublicKey) error {
+	return cred.Ver(sk, ipk)
+}
+
+func (p *softwareIdemixProvider) HashModOrder(data []byte) *amcl.BIG {
+	return idemix.HashModOrder(data)
 }
 
-// NewIdemixMsp creates a new instance of idemixmsp
+func (p *softwareIdemixProvider) BigToBytes(b *amcl.BIG) []byte {
+	return idemix.BigToBytes(b)
+}
+
+// pkcs11IdemixProvider is a stub for a PKCS#11-backed IdemixProvider. A full
+// implementation would import the user secret Sk (and the per-signature
+// RandNym) into the token as unextractable objects, and perform MakeNym and
+// NewSignature as PKCS#11 operations referencing those objects by handle
+// rather than by raw amcl.BIG value, so the scalars never leave the token.
+// That requires extending this interface with opaque key-handle types that
+// don't exist yet, so every method that would need to touch Sk or RandNym
+// by handle instead fails closed with an explicit "not implemented" error
+// rather than silently falling back to reading the plaintext scalar out of
+// process memory, which would defeat the point of configuring this
+// provider in the first place.
+type pkcs11IdemixProvider struct {
+	slot  uint
+	label string
+}
+
+// errPKCS11NotImplemented is returned by every pkcs11IdemixProvider
+// operation that would need to handle Sk or RandNym by token handle.
+var errPKCS11NotImplemented = errors.Errorf("pkcs11 idemix provider: not implemented")
+
+// NewPKCS11IdemixProvider returns an IdemixProvider that stores the Idemix
+// user secrets in the PKCS#11 token identified by slot and label. It is not
+// yet implemented.
+func NewPKCS11IdemixProvider(slot uint, label string) IdemixProvider {
+	return &pkcs11IdemixProvider{slot: slot, label: label}
+}
+
+func (p *pkcs11IdemixProvider) GetRand() (*amcl.RAND, error) {
+	return idemix.GetRand()
+}
+
+// MakeNym, for a real PKCS#11 back-end, should perform the scalar
+// multiplications that derive Nym inside the token, referencing sk by
+// handle, without ever reading sk back into process memory.
+func (p *pkcs11IdemixProvider) MakeNym(sk *amcl.BIG, ipk *idemix.IssuerPublicKey, rng *amcl.RAND) (*amcl.ECP, *amcl.BIG, error) {
+	return nil, nil, errPKCS11NotImplemented
+}
+
+// NewSignature, for a real PKCS#11 back-end, should sign using sk and
+// RandNym handles without ever reading the scalars back into process
+// memory.
+func (p *pkcs11IdemixProvider) NewSignature(cred *idemix.Credential, sk *amcl.BIG, Nym *amcl.ECP, RandNym *amcl.BIG, ipk *idemix.IssuerPublicKey, disclosure []byte, msg []byte, rhIndex int, cri *m.CredentialRevocationInformation, rng *amcl.RAND) (*idemix.Signature, error) {
+	return nil, errPKCS11NotImplemented
+}
+
+// VerifyCredential, for a real PKCS#11 back-end, should check the
+// credential using sk by handle rather than the raw scalar.
+func (p *pkcs11IdemixProvider) VerifyCredential(cred *idemix.Credential, sk *amcl.BIG, ipk *idemix.IssuerPublicKey) error {
+	return errPKCS11NotImplemented
+}
+
+func (p *pkcs11IdemixProvider) HashModOrder(data []byte) *amcl.BIG {
+	return idemix.HashModOrder(data)
+}
+
+func (p *pkcs11IdemixProvider) BigToBytes(b *amcl.BIG) []byte {
+	return idemix.BigToBytes(b)
+}
+
+// idemixWalletEntry holds one imported credential together with the secret
+// key material needed to derive fresh, unlinkable pseudonyms for it on
+// demand.
+type idemixWalletEntry struct {
+	id           *IdentityIdentifier
+	sk           *amcl.BIG
+	cred         *idemix.Credential
+	role         *m.MSPRole
+	ou           *m.OrganizationUnit
+	enrollmentID string
+	// attrs holds the plaintext values of any additional, schema-declared
+	// attributes beyond OU/Role/EnrollmentId/RevocationHandle, keyed by name.
+	attrs map[string]string
+}
+
+// IdemixCredential bundles the secret key material and CA-issued credential
+// needed to add a new signer to an idemixmsp's credential wallet via Import.
+type IdemixCredential struct {
+	Sk                           *amcl.BIG
+	Cred                         *idemix.Credential
+	OrganizationalUnitIdentifier string
+	IsAdmin                      bool
+	EnrollmentID                 string
+	// Attrs holds the plaintext values of any additional, schema-declared
+	// attributes beyond OU/Role/EnrollmentId/RevocationHandle, keyed by name.
+	Attrs map[string]string
+}
+
+// fieldBytesLen is the byte length of a serialized curve coordinate or
+// scalar on the curve used by idemix (an AMCL BN curve element).
+const fieldBytesLen = 32
+
+// ecpToBytes serializes a curve point as the concatenation of its affine
+// coordinates, mirroring the NymX/NymY encoding used elsewhere in this file.
+func ecpToBytes(p *amcl.ECP) []byte {
+	return append(idemix.BigToBytes(p.GetX()), idemix.BigToBytes(p.GetY())...)
+}
+
+// bytesToECP is the inverse of ecpToBytes.
+func bytesToECP(b []byte) (*amcl.ECP, error) {
+	if len(b) != 2*fieldBytesLen {
+		return nil, errors.Errorf("invalid point encoding: expected %d bytes, got %d", 2*fieldBytesLen, len(b))
+	}
+	return amcl.NewECPbigs(amcl.FromBytes(b[:fieldBytesLen]), amcl.FromBytes(b[fieldBytesLen:])), nil
+}
+
+// xorBytes combines data with a (repeated) keystream derived from key. It is
+// used as the symmetric step of the hybrid ElGamal encryption in
+// auditEnrollmentID / AuditorDecrypt.
+func xorBytes(key, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ key[i%len(key)]
+	}
+	return out
+}
+
+// NewIdemixMsp creates a new instance of idemixmsp, backed by the default
+// software IdemixProvider. Use NewIdemixMspWithProvider to back it with a
+// different IdemixProvider, e.g. one backed by an HSM.
 func NewIdemixMsp() (MSP, error) {
 	mspLogger.Debugf("Creating Idemix-based MSP instance")
 
-	msp := idemixmsp{}
+	msp := idemixmsp{provider: NewIdemixProvider()}
+	return &msp, nil
+}
+
+// NewIdemixMspWithProvider creates a new instance of idemixmsp backed by the
+// given IdemixProvider, e.g. one returned by NewPKCS11IdemixProvider. This is
+// the entry point operators use to opt an MSP into HSM-backed key storage
+// instead of the default in-process software provider.
+func NewIdemixMspWithProvider(provider IdemixProvider) (MSP, error) {
+	mspLogger.Debugf("Creating Idemix-based MSP instance with a custom provider")
+
+	if provider == nil {
+		return nil, errors.Errorf("cannot create idemix MSP: provider is nil")
+	}
+	msp := idemixmsp{provider: provider}
 	return &msp, nil
 }
 
@@ -64,6 +335,7 @@ func (msp *idemixmsp) Setup(conf1 *m.MSPConfig) error {
 	}
 
 	msp.name = conf.Name
+	msp.wallet = make(map[string]*idemixWalletEntry)
 	mspLogger.Debugf("Setting up Idemix MSP instance %s", msp.name)
 
 	ipk := new(idemix.IssuerPublicKey)
@@ -76,9 +348,28 @@ func (msp *idemixmsp) Setup(conf1 *m.MSPConfig) error {
 		return errors.WithMessage(err, "setting the hash of the issuer public key failed")
 	}
 
-	if len(ipk.AttributeNames) < 2 || ipk.AttributeNames[0] != AttributeNameOU || ipk.AttributeNames[1] != AttributeNameRole {
-		return errors.Errorf("ipk must have have attributes OU and Role")
+	if len(ipk.AttributeNames) < numFixedAttrs ||
+		ipk.AttributeNames[0] != AttributeNameOU ||
+		ipk.AttributeNames[1] != AttributeNameRole ||
+		ipk.AttributeNames[2] != AttributeNameEnrollmentId ||
+		ipk.AttributeNames[3] != AttributeNameRevocationHandle {
+		return errors.Errorf("ipk must have have attributes OU, Role, EnrollmentId, and RevocationHandle")
+	}
+
+	// Any attribute names beyond the four fixed ones form the MSP's
+	// extensible, user-declared attribute schema. conf.AttributeNames, when
+	// present, must agree with the ipk on this schema.
+	if len(conf.AttributeNames) > 0 {
+		if len(conf.AttributeNames) != len(ipk.AttributeNames) {
+			return errors.Errorf("ipk declares %d attributes, but config declares %d", len(ipk.AttributeNames), len(conf.AttributeNames))
+		}
+		for i, name := range conf.AttributeNames {
+			if ipk.AttributeNames[i] != name {
+				return errors.Errorf("ipk attribute %d is %s, but config declares %s", i, ipk.AttributeNames[i], name)
+			}
+		}
 	}
+	msp.attributeNames = ipk.AttributeNames
 
 	err = ipk.Check()
 	if err != nil {
@@ -86,13 +377,52 @@ func (msp *idemixmsp) Setup(conf1 *m.MSPConfig) error {
 	}
 	msp.ipk = ipk
 
-	rng, err := idemix.GetRand()
+	if msp.provider == nil {
+		msp.provider = NewIdemixProvider()
+	}
+
+	rng, err := msp.provider.GetRand()
 	if err != nil {
 		return errors.Wrap(err, "error initializing PRNG for idemix msp")
 	}
 
 	msp.rng = rng
 
+	if len(conf.RevocationPk) == 0 {
+		return errors.Errorf("setup error: missing revocation public key")
+	}
+	revocationPK, err := x509.ParsePKIXPublicKey(conf.RevocationPk)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse revocation public key")
+	}
+	ecdsaRevocationPK, ok := revocationPK.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.Errorf("revocation public key is not an ECDSA public key")
+	}
+	msp.revocationPK = ecdsaRevocationPK
+
+	msp.criFreshnessWindow = defaultCRIFreshnessWindow
+	if conf.CriFreshnessSeconds > 0 {
+		msp.criFreshnessWindow = time.Duration(conf.CriFreshnessSeconds) * time.Second
+	}
+
+	if conf.Cri == nil {
+		return errors.Errorf("setup error: missing credential revocation information")
+	}
+	if err := msp.setCRI(conf.Cri); err != nil {
+		return errors.WithMessage(err, "setup error: invalid credential revocation information")
+	}
+
+	// The auditor key is optional: an idemix MSP with no auditor configured
+	// simply never attaches enrollment-id audit records to its signatures.
+	if len(conf.AuditorPk) > 0 {
+		auditorPK, err := bytesToECP(conf.AuditorPk)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse auditor public key")
+		}
+		msp.auditorPK = auditorPK
+	}
+
 	if conf.Signer == nil {
 		// No credential in config, so we don't setup a default signer
 		mspLogger.Debug("idemix msp setup as verification only msp (no key material found)")
@@ -108,7 +438,10 @@ func (msp *idemixmsp) Setup(conf1 *m.MSPConfig) error {
 
 	sk := amcl.FromBytes(conf.Signer.Sk)
 
-	Nym, RandNym := idemix.MakeNym(sk, msp.ipk, rng)
+	Nym, RandNym, err := msp.provider.MakeNym(sk, msp.ipk, rng)
+	if err != nil {
+		return errors.Wrap(err, "failed to derive default signer's pseudonym")
+	}
 	role := &m.MSPRole{
 		msp.name,
 		m.MSPRole_MEMBER,
@@ -123,41 +456,370 @@ func (msp *idemixmsp) Setup(conf1 *m.MSPConfig) error {
 		nil,
 	}
 
-	// Check if credential contains the right amount of attribute values (Role and OU)
-	if len(cred.Attrs) != 2 {
-		return errors.Errorf("Credential contains %d attribute values, but expected 2", len(cred.Attrs))
+	// Check that the credential's attribute vector matches the OU/Role/
+	// EnrollmentId/rich attribute values claimed alongside it.
+	richAttrs, err := msp.validateCredentialAttrs(ou, role, conf.Signer.EnrollmentId, conf.Signer.Attrs, cred)
+	if err != nil {
+		return errors.WithMessage(err, "Setting up default signer failed")
+	}
+
+	// Verify that the credential is cryptographically valid
+	err = msp.provider.VerifyCredential(cred, sk, msp.ipk)
+	if err != nil {
+		return errors.Wrap(err, "Credential is not cryptographically valid")
+	}
+
+	// Check that the credential's revocation handle has not already been revoked
+	// under the currently installed CRI.
+	revocationHandle := cred.Attrs[rhIndex]
+	if msp.isRevoked(revocationHandle) {
+		return errors.Errorf("cannot set up default signer: revocation handle has been revoked")
+	}
+
+	// The default signer gets its own PRNG, independent of msp.rng and of
+	// every other signing identity's PRNG: amcl.RAND is not safe for
+	// concurrent use, and signing (NewSignature, SignWithNym) draws
+	// randomness from it on every call, so sharing one generator across
+	// concurrently-used identities would race and risks correlated or
+	// reused nonces in the underlying Schnorr-style proofs.
+	signerRng, err := msp.provider.GetRand()
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize PRNG for default signer")
+	}
+
+	// Set up default signer
+	msp.signer = &idemixSigningIdentity{newIdemixIdentity(msp, Nym, role, ou), signerRng, cred, sk, RandNym, conf.Signer.EnrollmentId, richAttrs}
+
+	// Additional signers beyond the default one are loaded into the
+	// credential wallet so that GetSigningIdentity can hand them out later.
+	for _, additional := range conf.AdditionalSigners {
+		additionalCred := new(idemix.Credential)
+		if err := proto.Unmarshal(additional.Cred, additionalCred); err != nil {
+			return errors.Wrap(err, "failed to unmarshal additional signer credential from config")
+		}
+		// Import independently verifies cryptographic validity and checks
+		// the claimed OU/Role/EnrollmentId/rich attributes against the
+		// values committed in the credential itself, so an additional
+		// signer can't be given a role or OU it wasn't actually issued.
+		if err := msp.Import(&IdemixCredential{
+			Sk:                           amcl.FromBytes(additional.Sk),
+			Cred:                         additionalCred,
+			OrganizationalUnitIdentifier: additional.OrganizationalUnitIdentifier,
+			IsAdmin:                      additional.IsAdmin,
+			EnrollmentID:                 additional.EnrollmentId,
+			Attrs:                        additional.Attrs,
+		}); err != nil {
+			return errors.Wrap(err, "failed to import additional signer into credential wallet")
+		}
+	}
+
+	return nil
+}
+
+// checkRichAttrs validates that the plaintext attribute values supplied in
+// attrs match what is committed to in cred for every attribute beyond the
+// four fixed ones, and returns them keyed by name for later selective
+// disclosure via SignWithDisclosure.
+func (msp *idemixmsp) checkRichAttrs(attrs map[string]string, cred *idemix.Credential) (map[string]string, error) {
+	richAttrs := make(map[string]string, len(msp.attributeNames)-numFixedAttrs)
+	for i := numFixedAttrs; i < len(msp.attributeNames); i++ {
+		name := msp.attributeNames[i]
+		value := attrs[name]
+		if !bytes.Equal(msp.provider.BigToBytes(msp.provider.HashModOrder([]byte(value))), cred.Attrs[i]) {
+			return nil, errors.Errorf("credential does not contain the correct %s attribute value", name)
+		}
+		richAttrs[name] = value
+	}
+	return richAttrs, nil
+}
+
+// validateCredentialAttrs checks that cred's committed attribute vector
+// matches the OU, Role, EnrollmentID and any rich attribute values claimed
+// alongside it, the same way Setup validates its default signer. This is
+// what prevents a credential file from being paired with claims (e.g. an
+// unearned IsAdmin) that the issuer never actually signed off on.
+func (msp *idemixmsp) validateCredentialAttrs(ou *m.OrganizationUnit, role *m.MSPRole, enrollmentID string, richAttrs map[string]string, cred *idemix.Credential) (map[string]string, error) {
+	// Check if credential contains the right amount of attribute values: the
+	// four fixed attributes plus any additional ones declared in the schema.
+	if len(cred.Attrs) != len(msp.attributeNames) {
+		return nil, errors.Errorf("Credential contains %d attribute values, but expected %d", len(cred.Attrs), len(msp.attributeNames))
 	}
 
 	// Check if credential contains the correct OU attribute value
 	ouBytes, err := proto.Marshal(ou)
 	if err != nil {
-		return errors.Wrap(err, "Setting up default signer failed")
+		return nil, err
 	}
-	if !bytes.Equal(idemix.BigToBytes(idemix.HashModOrder(ouBytes)), cred.Attrs[0]) {
-		return errors.New("Credential does not contain the correct OU attribute value")
+	if !bytes.Equal(msp.provider.BigToBytes(msp.provider.HashModOrder(ouBytes)), cred.Attrs[0]) {
+		return nil, errors.New("Credential does not contain the correct OU attribute value")
 	}
 
-	// Check if credential contains the correct OU attribute value
+	// Check if credential contains the correct Role attribute value
 	roleBytes, err := proto.Marshal(role)
 	if err != nil {
-		return errors.Wrap(err, "Setting up default signer failed")
+		return nil, err
 	}
-	if !bytes.Equal(idemix.BigToBytes(idemix.HashModOrder(roleBytes)), cred.Attrs[1]) {
-		return errors.New("Credential does not contain the correct Role attribute value")
+	if !bytes.Equal(msp.provider.BigToBytes(msp.provider.HashModOrder(roleBytes)), cred.Attrs[1]) {
+		return nil, errors.New("Credential does not contain the correct Role attribute value")
 	}
 
-	// Verify that the credential is cryptographically valid
-	err = cred.Ver(sk, msp.ipk)
+	// Check if credential contains the correct EnrollmentId attribute value
+	if !bytes.Equal(msp.provider.BigToBytes(msp.provider.HashModOrder([]byte(enrollmentID))), cred.Attrs[eidIndex]) {
+		return nil, errors.New("Credential does not contain the correct EnrollmentId attribute value")
+	}
+
+	// Check that any additional, schema-declared attribute values match
+	// what is committed to in the credential.
+	return msp.checkRichAttrs(richAttrs, cred)
+}
+
+// walletID derives the stable wallet key for a credential from its
+// (already unique) revocation handle attribute, so the same credential is
+// always addressable under the same IdentityIdentifier across imports.
+func walletID(cred *idemix.Credential) string {
+	return hex.EncodeToString(cred.Attrs[rhIndex])
+}
+
+// Import adds a credential to the MSP's wallet, making it available for
+// retrieval via GetSigningIdentity. If a walletDir has been configured, the
+// entry is also persisted to disk.
+func (msp *idemixmsp) Import(cred *IdemixCredential) error {
+	if cred == nil || cred.Cred == nil || cred.Sk == nil {
+		return errors.Errorf("cannot import: incomplete idemix credential")
+	}
+	if msp.isRevoked(cred.Cred.Attrs[rhIndex]) {
+		return errors.Errorf("cannot import: revocation handle has been revoked")
+	}
+
+	if err := msp.provider.VerifyCredential(cred.Cred, cred.Sk, msp.ipk); err != nil {
+		return errors.Wrap(err, "cannot import: credential is not cryptographically valid")
+	}
+
+	role := &m.MSPRole{MspIdentifier: msp.name, Role: m.MSPRole_MEMBER}
+	if cred.IsAdmin {
+		role.Role = m.MSPRole_ADMIN
+	}
+	ou := &m.OrganizationUnit{
+		MspIdentifier:                msp.name,
+		OrganizationalUnitIdentifier: cred.OrganizationalUnitIdentifier,
+	}
+
+	richAttrs, err := msp.validateCredentialAttrs(ou, role, cred.EnrollmentID, cred.Attrs, cred.Cred)
 	if err != nil {
-		return errors.Wrap(err, "Credential is not cryptographically valid")
+		return errors.WithMessage(err, "cannot import")
 	}
 
-	// Set up default signer
-	msp.signer = &idemixSigningIdentity{newIdemixIdentity(msp, Nym, role, ou), rng, cred, sk, RandNym}
+	id := walletID(cred.Cred)
+	entry := &idemixWalletEntry{
+		id:           &IdentityIdentifier{Mspid: msp.name, Id: id},
+		sk:           cred.Sk,
+		cred:         cred.Cred,
+		role:         role,
+		ou:           ou,
+		enrollmentID: cred.EnrollmentID,
+		attrs:        richAttrs,
+	}
+	msp.wallet[id] = entry
+
+	if msp.walletDir != "" {
+		if err := persistWalletEntry(msp.walletDir, id, cred); err != nil {
+			return errors.Wrap(err, "failed to persist wallet entry")
+		}
+	}
+
+	return nil
+}
+
+// List returns the identifiers of every credential currently held in the
+// wallet. The default signer is not held in the wallet and is not listed.
+func (msp *idemixmsp) List() []*IdentityIdentifier {
+	ids := make([]*IdentityIdentifier, 0, len(msp.wallet))
+	for _, entry := range msp.wallet {
+		ids = append(ids, entry.id)
+	}
+	return ids
+}
+
+// LoadWallet populates the MSP's credential wallet from entries persisted
+// under dir, and configures dir as the location new Import calls persist to.
+// This mirrors how X.509 MSPs load their keystore/ and signcerts/
+// directories at setup time.
+func (msp *idemixmsp) LoadWallet(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		msp.walletDir = dir
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read idemix wallet directory")
+	}
+
+	// walletDir is deliberately left unset while replaying existing entries:
+	// Import persists to msp.walletDir whenever it's set, and every entry
+	// loaded here is, by definition, already on disk. Setting it only after
+	// the load loop completes avoids rewriting every credential's secret key
+	// and credential bytes back to disk on every single MSP startup.
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		cred, err := loadWalletEntry(dir, entry.Name())
+		if err != nil {
+			return errors.Wrapf(err, "failed to load wallet entry %s", entry.Name())
+		}
+		if err := msp.Import(cred); err != nil {
+			return errors.Wrapf(err, "failed to import wallet entry %s", entry.Name())
+		}
+	}
+
+	msp.walletDir = dir
+	return nil
+}
+
+// persistWalletEntry writes a wallet entry's secret key and credential to
+// <dir>/<id>/sk and <dir>/<id>/cred, following the same leaf-file-per-secret
+// layout used by the X.509 MSP's keystore/.
+func persistWalletEntry(dir string, id string, cred *IdemixCredential) error {
+	entryDir := filepath.Join(dir, id)
+	if err := os.MkdirAll(entryDir, 0750); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(entryDir, "sk"), idemix.BigToBytes(cred.Sk), 0600); err != nil {
+		return err
+	}
+	credBytes, err := proto.Marshal(cred.Cred)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(entryDir, "cred"), credBytes, 0600); err != nil {
+		return err
+	}
+	ouAndAdmin := []byte(cred.OrganizationalUnitIdentifier)
+	if cred.IsAdmin {
+		ouAndAdmin = append(ouAndAdmin, 1)
+	} else {
+		ouAndAdmin = append(ouAndAdmin, 0)
+	}
+	if err := ioutil.WriteFile(filepath.Join(entryDir, "ou"), ouAndAdmin, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(entryDir, "enrollmentid"), []byte(cred.EnrollmentID), 0600); err != nil {
+		return err
+	}
+	attrsBytes, err := json.Marshal(cred.Attrs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(entryDir, "attrs.json"), attrsBytes, 0600)
+}
+
+// loadWalletEntry is the inverse of persistWalletEntry.
+func loadWalletEntry(dir string, id string) (*IdemixCredential, error) {
+	entryDir := filepath.Join(dir, id)
 
+	skBytes, err := ioutil.ReadFile(filepath.Join(entryDir, "sk"))
+	if err != nil {
+		return nil, err
+	}
+	credBytes, err := ioutil.ReadFile(filepath.Join(entryDir, "cred"))
+	if err != nil {
+		return nil, err
+	}
+	cred := new(idemix.Credential)
+	if err := proto.Unmarshal(credBytes, cred); err != nil {
+		return nil, err
+	}
+	ouAndAdmin, err := ioutil.ReadFile(filepath.Join(entryDir, "ou"))
+	if err != nil {
+		return nil, err
+	}
+	if len(ouAndAdmin) == 0 {
+		return nil, errors.Errorf("malformed ou file for wallet entry %s", id)
+	}
+	enrollmentID, err := ioutil.ReadFile(filepath.Join(entryDir, "enrollmentid"))
+	if err != nil {
+		return nil, err
+	}
+	attrsBytes, err := ioutil.ReadFile(filepath.Join(entryDir, "attrs.json"))
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string]string
+	if err := json.Unmarshal(attrsBytes, &attrs); err != nil {
+		return nil, err
+	}
+
+	return &IdemixCredential{
+		Sk:                           amcl.FromBytes(skBytes),
+		Cred:                         cred,
+		OrganizationalUnitIdentifier: string(ouAndAdmin[:len(ouAndAdmin)-1]),
+		IsAdmin:                      ouAndAdmin[len(ouAndAdmin)-1] == 1,
+		EnrollmentID:                 string(enrollmentID),
+		Attrs:                        attrs,
+	}, nil
+}
+
+// setCRI verifies the issuer's signature over the supplied Credential
+// Revocation Information and, if valid, installs it as the currently
+// active CRI for this MSP instance.
+func (msp *idemixmsp) setCRI(cri *m.CredentialRevocationInformation) error {
+	if cri == nil {
+		return errors.Errorf("no credential revocation information supplied")
+	}
+
+	digest := criDigest(cri.Epoch, cri.RevokedHandles)
+	if !ecdsa.VerifyASN1(msp.revocationPK, digest, cri.EpochSignature) {
+		return errors.Errorf("invalid signature over credential revocation information")
+	}
+
+	msp.cri = cri
 	return nil
 }
 
+// checkCRIFreshness rejects a stale installed CRI. cri.Epoch is the Unix
+// timestamp (seconds) at which the issuer published it; a CRI older than
+// msp.criFreshnessWindow can no longer be trusted to reflect the current
+// revocation state, so identities must not be accepted against it even
+// though its signature is still valid.
+func (msp *idemixmsp) checkCRIFreshness() error {
+	if msp.cri == nil {
+		return errors.Errorf("no credential revocation information installed")
+	}
+	age := time.Now().Unix() - msp.cri.Epoch
+	if age < 0 || time.Duration(age)*time.Second > msp.criFreshnessWindow {
+		return errors.Errorf("credential revocation information is stale: epoch %d is outside the freshness window of %s", msp.cri.Epoch, msp.criFreshnessWindow)
+	}
+	return nil
+}
+
+// SetCRI hot-swaps the Credential Revocation Information used by this MSP
+// instance without re-running Setup. It is intended to be called whenever
+// the issuer publishes a new CRI for a fresh epoch.
+func (msp *idemixmsp) SetCRI(cri *m.CredentialRevocationInformation) error {
+	return msp.setCRI(cri)
+}
+
+// isRevoked reports whether the given revocation handle appears in the
+// currently installed CRI.
+func (msp *idemixmsp) isRevoked(revocationHandle []byte) bool {
+	if msp.cri == nil {
+		return false
+	}
+	for _, rh := range msp.cri.RevokedHandles {
+		if bytes.Equal(rh, revocationHandle) {
+			return true
+		}
+	}
+	return false
+}
+
+// criDigest computes the digest that the issuer signs over when publishing
+// a Credential Revocation Information for the given epoch.
+func criDigest(epoch int64, revokedHandles [][]byte) []byte {
+	h := idemix.HashModOrder(append(idemix.BigToBytes(amcl.NewBIGint(int(epoch))), bytes.Join(revokedHandles, nil)...))
+	return idemix.BigToBytes(h)
+}
+
 func (msp *idemixmsp) GetType() ProviderType {
 	return IDEMIX
 }
@@ -167,7 +829,42 @@ func (msp *idemixmsp) GetIdentifier() (string, error) {
 }
 
 func (msp *idemixmsp) GetSigningIdentity(identifier *IdentityIdentifier) (SigningIdentity, error) {
-	return nil, errors.Errorf("GetSigningIdentity not implemented")
+	if identifier == nil {
+		return nil, errors.Errorf("GetSigningIdentity error: nil identifier")
+	}
+
+	entry, ok := msp.wallet[identifier.Id]
+	if !ok {
+		return nil, errors.Errorf("no signing identity found in wallet for identifier %s", identifier.Id)
+	}
+
+	// A fresh pseudonym is derived on every call so that repeated use of the
+	// same wallet entry across transactions remains unlinkable.
+	Nym, RandNym, err := msp.provider.MakeNym(entry.sk, msp.ipk, msp.rng)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive pseudonym")
+	}
+
+	// Each returned signing identity gets its own PRNG rather than sharing
+	// msp.rng: amcl.RAND is not safe for concurrent use, and signing draws
+	// randomness from it on every call, so callers that hold signing
+	// identities for concurrent/high-volume use (e.g. SignWithNym) would
+	// otherwise race on one mutable generator and risk correlated or
+	// reused nonces in the underlying Schnorr-style proofs.
+	signerRng, err := msp.provider.GetRand()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize PRNG for signing identity")
+	}
+
+	return &idemixSigningIdentity{
+		newIdemixIdentity(msp, Nym, entry.role, entry.ou),
+		signerRng,
+		entry.cred,
+		entry.sk,
+		RandNym,
+		entry.enrollmentID,
+		entry.attrs,
+	}, nil
 }
 
 func (msp *idemixmsp) GetDefaultSigningIdentity() (SigningIdentity, error) {
@@ -233,10 +930,20 @@ func (msp *idemixmsp) Validate(id Identity) error {
 		}
 		return msp.ipk.Check()
 	case *idemixSigningIdentity:
-		if id.(*idemixSigningIdentity).GetMSPIdentifier() != msp.name {
+		signingID := id.(*idemixSigningIdentity)
+		if signingID.GetMSPIdentifier() != msp.name {
 			return errors.Errorf("the supplied identity does not belong to this msp")
 		}
-		return msp.ipk.Check()
+		if err := msp.ipk.Check(); err != nil {
+			return err
+		}
+		if err := msp.checkCRIFreshness(); err != nil {
+			return errors.WithMessage(err, "cannot validate identity")
+		}
+		if msp.isRevoked(signingID.Cred.Attrs[rhIndex]) {
+			return errors.Errorf("identity has been revoked: its revocation handle appears in the current epoch's CRI")
+		}
+		return nil
 	default:
 		return errors.Errorf("identity type %T is not recognized", t)
 	}
@@ -323,11 +1030,74 @@ func (msp *idemixmsp) SatisfiesPrincipal(id Identity, principal *m.MSPPrincipal)
 		}
 
 		return nil
+
+	case m.MSPPrincipal_IDEMIX_ATTRIBUTE:
+		attr := &m.MSPIdemixAttribute{}
+		err := proto.Unmarshal(principal.Principal, attr)
+		if err != nil {
+			return errors.Wrap(err, "could not unmarshal MSPIdemixAttribute from principal")
+		}
+
+		mspLogger.Debugf("Checking if identity discloses attribute \"%s\" = \"%s\"", attr.AttributeName, attr.AttributeValue)
+
+		err = msp.Validate(id)
+		if err != nil {
+			return err
+		}
+
+		// The attributes a signature discloses are a property of that one
+		// signature, not of the long-lived identity object, so they cannot
+		// be read off id here: callers evaluating an IDEMIX_ATTRIBUTE
+		// principal must go through SatisfiesPrincipalWithAttributes and
+		// pass in the disclosed attributes recovered from the signature
+		// they are validating.
+		return errors.Errorf("cannot evaluate an idemix attribute principal through SatisfiesPrincipal: use SatisfiesPrincipalWithAttributes with the attributes disclosed by the signature being checked")
+
 	default:
 		return errors.Errorf("invalid principal type %d", int32(principal.PrincipalClassification))
 	}
 }
 
+// SatisfiesPrincipalWithAttributes behaves like SatisfiesPrincipal, except
+// that for an MSPPrincipal_IDEMIX_ATTRIBUTE principal it checks against the
+// supplied disclosedAttrs rather than any state cached on id. disclosedAttrs
+// should be the map returned by idemixidentity.VerifyWithAttributes for the
+// specific signature the principal is being checked against: unlike id,
+// which the MSP's identity cache may hand out and reuse across many
+// signatures, disclosedAttrs is scoped to a single signature and so cannot
+// leak one signature's disclosures into another's principal evaluation.
+func (msp *idemixmsp) SatisfiesPrincipalWithAttributes(id Identity, principal *m.MSPPrincipal, disclosedAttrs map[string][]byte) error {
+	if principal.PrincipalClassification != m.MSPPrincipal_IDEMIX_ATTRIBUTE {
+		return msp.SatisfiesPrincipal(id, principal)
+	}
+
+	attr := &m.MSPIdemixAttribute{}
+	err := proto.Unmarshal(principal.Principal, attr)
+	if err != nil {
+		return errors.Wrap(err, "could not unmarshal MSPIdemixAttribute from principal")
+	}
+
+	mspLogger.Debugf("Checking if identity discloses attribute \"%s\" = \"%s\"", attr.AttributeName, attr.AttributeValue)
+
+	if err := msp.Validate(id); err != nil {
+		return err
+	}
+
+	if _, ok := id.(*idemixidentity); !ok {
+		return errors.Errorf("identity type %T cannot satisfy an idemix attribute principal", id)
+	}
+
+	disclosed, ok := disclosedAttrs[attr.AttributeName]
+	if !ok {
+		return errors.Errorf("identity did not disclose attribute \"%s\"", attr.AttributeName)
+	}
+	if string(disclosed) != attr.AttributeValue {
+		return errors.Errorf("attribute \"%s\" does not match the expected value", attr.AttributeName)
+	}
+
+	return nil
+}
+
 func (msp *idemixmsp) GetTLSRootCerts() [][]byte {
 	// TODO
 	return nil
@@ -386,26 +1156,132 @@ func (id *idemixidentity) Validate() error {
 }
 
 func (id *idemixidentity) Verify(msg []byte, sig []byte) error {
+	_, err := id.VerifyWithAttributes(msg, sig)
+	return err
+}
+
+// VerifyWithAttributes behaves like Verify, but additionally returns the
+// plaintext values of whichever schema-declared attributes this particular
+// signature chose to disclose via SignWithDisclosure, keyed by name. Unlike
+// an earlier version of this method, the disclosed attributes are returned
+// rather than cached on id: id may be a long-lived object the MSP's identity
+// cache hands out and reuses across many signatures and concurrent
+// verifications, so stashing per-signature data on it would let one
+// signature's disclosures leak into another's principal evaluation. Callers
+// that need to check an MSPPrincipal_IDEMIX_ATTRIBUTE principal against this
+// signature should pass the returned map to SatisfiesPrincipalWithAttributes.
+func (id *idemixidentity) VerifyWithAttributes(msg []byte, sig []byte) (map[string][]byte, error) {
 	if mspLogger.IsEnabledFor(logging.DEBUG) {
 		mspIdentityLogger.Debugf("Verify Idemix sig: msg = %s", hex.Dump(msg))
 		mspIdentityLogger.Debugf("Verify Idemix sig: sig = %s", hex.Dump(sig))
 	}
 
+	envelope := new(m.IdemixSignatureEnvelope)
+	if err := proto.Unmarshal(sig, envelope); err != nil {
+		return nil, errors.Wrap(err, "error unmarshalling idemix signature envelope")
+	}
+
+	if envelope.Audit != nil {
+		if err := verifyEnrollmentIDAudit(id.msp.ipk, envelope.Audit, id.Nym, msg); err != nil {
+			return nil, errors.Wrap(err, "enrollment-id audit proof is invalid")
+		}
+	}
+	if len(envelope.AttrNames) != len(envelope.AttrValues) {
+		return nil, errors.Errorf("malformed signature: %d disclosed attribute names but %d values", len(envelope.AttrNames), len(envelope.AttrValues))
+	}
+
 	signature := new(idemix.Signature)
-	err := proto.Unmarshal(sig, signature)
+	err := proto.Unmarshal(envelope.IdemixSig, signature)
 	if err != nil {
-		return errors.Wrap(err, "error unmarshalling signature")
+		return nil, errors.Wrap(err, "error unmarshalling signature")
 	}
 	ouBytes, err := proto.Marshal(id.OU)
 	if err != nil {
-		return errors.Wrapf(err, "error marshalling OU of identity %s", id.GetIdentifier())
+		return nil, errors.Wrapf(err, "error marshalling OU of identity %s", id.GetIdentifier())
 	}
 	roleBytes, err := proto.Marshal(id.Role)
 	if err != nil {
-		return errors.Wrapf(err, "error marshalling Role of identity %s", id.GetIdentifier())
+		return nil, errors.Wrapf(err, "error marshalling Role of identity %s", id.GetIdentifier())
+	}
+	// EnrollmentID and RevocationHandle are never disclosed: the verifier
+	// only learns, via the signature's non-revocation proof, that the
+	// signer's (hidden) revocation handle is absent from the current
+	// epoch's CRI. Any other schema-declared attribute is disclosed, or
+	// not, on a per-signature basis according to envelope.AttrNames.
+	flags := make([]byte, len(id.msp.attributeNames))
+	copy(flags, discloseFlags)
+	attributeValues := make([]*amcl.BIG, len(id.msp.attributeNames))
+	attributeValues[0] = id.msp.provider.HashModOrder(ouBytes)
+	attributeValues[1] = id.msp.provider.HashModOrder(roleBytes)
+
+	disclosed := make(map[string][]byte, len(envelope.AttrNames))
+	for i, name := range envelope.AttrNames {
+		idx := indexOf(id.msp.attributeNames, name)
+		if idx < numFixedAttrs {
+			return nil, errors.Errorf("signature discloses invalid attribute %s", name)
+		}
+		value := envelope.AttrValues[i]
+		flags[idx] = 1
+		attributeValues[idx] = id.msp.provider.HashModOrder([]byte(value))
+		disclosed[name] = []byte(value)
+	}
+
+	if err := id.msp.checkCRIFreshness(); err != nil {
+		return nil, errors.WithMessage(err, "cannot verify signature")
+	}
+	if err := signature.Ver(flags, id.msp.ipk, msg, attributeValues, rhIndex, id.msp.cri); err != nil {
+		return nil, err
 	}
-	attributeValues := []*amcl.BIG{idemix.HashModOrder(ouBytes), idemix.HashModOrder(roleBytes)}
-	return signature.Ver(discloseFlags, id.msp.ipk, msg, attributeValues)
+
+	return disclosed, nil
+}
+
+// indexOf returns the index of name in names, or -1 if absent.
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// VerifyNymSignature checks a lightweight pseudonym-only signature produced
+// by SignWithNym. It proves knowledge of the pseudonym's secret but, unlike
+// Verify, does not re-check possession of a CA-issued credential; callers
+// should only rely on it for identities that have already presented a valid
+// full Idemix signature in the current session.
+func (id *idemixidentity) VerifyNymSignature(msg []byte, sig []byte) error {
+	nymSig := new(m.NymSignature)
+	err := proto.Unmarshal(sig, nymSig)
+	if err != nil {
+		return errors.Wrap(err, "error unmarshalling nym signature")
+	}
+
+	proofC := amcl.FromBytes(nymSig.ProofC)
+	proofSSk := amcl.FromBytes(nymSig.ProofSSk)
+	proofSRNym := amcl.FromBytes(nymSig.ProofSRNym)
+
+	// t = HSk^proofSSk . HRand^proofSRNym . Nym^(-proofC)
+	t := id.msp.ipk.HSk.Mul(proofSSk)
+	t.Add(id.msp.ipk.HRand.Mul(proofSRNym))
+	negC := amcl.ModNeg(proofC, idemix.GroupOrder)
+	t.Add(id.Nym.Mul(negC))
+
+	proofData := bytes.Join([][]byte{
+		idemix.BigToBytes(t.GetX()),
+		idemix.BigToBytes(t.GetY()),
+		idemix.BigToBytes(id.Nym.GetX()),
+		idemix.BigToBytes(id.Nym.GetY()),
+		nymSig.Nonce,
+		msg,
+	}, nil)
+	recomputedC := idemix.HashModOrder(proofData)
+
+	if !bytes.Equal(idemix.BigToBytes(recomputedC), nymSig.ProofC) {
+		return errors.Errorf("nym signature is invalid: challenge does not match")
+	}
+	return nil
 }
 
 func (id *idemixidentity) SatisfiesPrincipal(principal *m.MSPPrincipal) error {
@@ -449,13 +1325,263 @@ type idemixSigningIdentity struct {
 	Cred    *idemix.Credential
 	Sk      *amcl.BIG
 	RandNym *amcl.BIG
+	// EnrollmentID is the signer's plaintext enrollment identifier, whose
+	// hash is committed to in Cred.Attrs[eidIndex]. It never leaves this
+	// struct except, optionally, encrypted under an auditor's key by Sign.
+	EnrollmentID string
+	// Attrs holds the plaintext values of any additional, schema-declared
+	// attributes beyond OU/Role/EnrollmentId/RevocationHandle, keyed by
+	// name, for selective disclosure via SignWithDisclosure.
+	Attrs map[string]string
 }
 
 func (id *idemixSigningIdentity) Sign(msg []byte) ([]byte, error) {
+	return id.signWithDisclosure(msg, nil)
+}
+
+// SignWithDisclosure is like Sign, but additionally reveals the plaintext
+// values of the named attributes (which must be declared in the MSP's
+// attribute schema beyond the fixed OU/Role/EnrollmentId/RevocationHandle
+// ones). Every attribute not named in disclose remains zero-knowledge
+// proven but hidden, exactly as under Sign. EnrollmentId and
+// RevocationHandle can never be disclosed this way: they stay hidden
+// regardless of disclose, to preserve unlinkability and revocation safety.
+func (id *idemixSigningIdentity) SignWithDisclosure(msg []byte, disclose []string) ([]byte, error) {
+	return id.signWithDisclosure(msg, disclose)
+}
+
+func (id *idemixSigningIdentity) signWithDisclosure(msg []byte, disclose []string) ([]byte, error) {
 	mspLogger.Debugf("Idemix identity %s is signing", id.GetIdentifier())
-	return proto.Marshal(idemix.NewSignature(id.Cred, id.Sk, id.Nym, id.RandNym, id.msp.ipk, discloseFlags, msg, id.rng))
+	if err := id.msp.checkCRIFreshness(); err != nil {
+		return nil, errors.WithMessage(err, "cannot sign")
+	}
+
+	flags := id.buildDiscloseFlags(disclose)
+
+	// NewSignature additionally produces a non-revocation proof, showing in
+	// zero knowledge that the signer's revocation handle (attribute rhIndex)
+	// is absent from id.msp.cri's revoked set for the CRI's current epoch.
+	signature, err := id.msp.provider.NewSignature(id.Cred, id.Sk, id.Nym, id.RandNym, id.msp.ipk, flags, msg, rhIndex, id.msp.cri, id.rng)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to produce idemix signature")
+	}
+	sigBytes, err := proto.Marshal(signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal idemix signature")
+	}
+
+	envelope := &m.IdemixSignatureEnvelope{IdemixSig: sigBytes}
+
+	// Carry the plaintext of every disclosed, schema-declared attribute so
+	// the verifier can recompute the commitment it needs to check the
+	// signature against, the same way it already does for OU and Role.
+	for i := numFixedAttrs; i < len(flags); i++ {
+		if flags[i] == 1 {
+			name := id.msp.attributeNames[i]
+			envelope.AttrNames = append(envelope.AttrNames, name)
+			envelope.AttrValues = append(envelope.AttrValues, id.Attrs[name])
+		}
+	}
+
+	if id.msp.auditorPK != nil {
+		// An auditor is configured for this MSP: attach a ZK-provable
+		// encryption of the enrollment ID so a designated auditor can later
+		// de-anonymize this signature, while ordinary verifiers learn
+		// nothing beyond the fact that the proof is valid.
+		audit, err := id.auditEnrollmentID(msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to produce enrollment-id audit record")
+		}
+		envelope.Audit = audit
+	}
+
+	return proto.Marshal(envelope)
+}
+
+// buildDiscloseFlags returns a disclosure bitmap covering every attribute in
+// id.msp.attributeNames: OU and Role are always disclosed, EnrollmentId and
+// RevocationHandle always stay hidden, and any schema-declared attribute
+// named in reveal is additionally disclosed.
+func (id *idemixSigningIdentity) buildDiscloseFlags(reveal []string) []byte {
+	flags := make([]byte, len(id.msp.attributeNames))
+	copy(flags, discloseFlags)
+	for _, name := range reveal {
+		for i := numFixedAttrs; i < len(id.msp.attributeNames); i++ {
+			if id.msp.attributeNames[i] == name {
+				flags[i] = 1
+			}
+		}
+	}
+	return flags
+}
+
+// auditEnrollmentID ElGamal-encrypts id.EnrollmentID under the MSP's
+// auditor public key and produces a Schnorr proof of equality showing that
+// the value hidden behind the ciphertext is the very same value committed
+// to in id.Cred.Attrs[eidIndex]: C1 and Ceid are proven to share the same
+// encryption randomness r, and Ceid is a Pedersen commitment HSk^m.HRand^r
+// to m, the credential's own committed enrollment-id attribute (not a
+// value the signer is free to choose independently of the credential).
+// AuditorDecrypt re-derives m from the decrypted plaintext and checks it
+// against Ceid, so a signer cannot XOR an arbitrary string into Ciphertext
+// and still have it survive that check.
+func (id *idemixSigningIdentity) auditEnrollmentID(msg []byte) (*m.EnrollmentIDAudit, error) {
+	r := amcl.RandModOrder(id.rng)
+	mEid := amcl.FromBytes(id.Cred.Attrs[eidIndex])
+
+	// Diffie-Hellman shared secret with the auditor, used to derive a
+	// one-time keystream for the (otherwise undecryptable-by-verifiers)
+	// enrollment ID.
+	shared := id.msp.auditorPK.Mul(r)
+	c1 := id.msp.ipk.HRand.Mul(r)
+	keyBytes := idemix.BigToBytes(idemix.HashModOrder(ecpToBytes(shared)))
+	ciphertext := xorBytes(keyBytes, []byte(id.EnrollmentID))
+
+	// Ceid commits to the credential's own eidIndex attribute under the
+	// same randomness r used for C1, binding the two together.
+	ceid := id.msp.ipk.HSk.Mul(mEid)
+	ceid.Add(c1)
+
+	rt := amcl.RandModOrder(id.rng)
+	mt := amcl.RandModOrder(id.rng)
+	t1 := id.msp.ipk.HRand.Mul(rt)
+	t2 := id.msp.ipk.HSk.Mul(mt)
+	t2.Add(id.msp.ipk.HRand.Mul(rt))
+
+	challenge := idemix.HashModOrder(bytes.Join([][]byte{
+		ecpToBytes(t1), ecpToBytes(t2), ecpToBytes(c1), ecpToBytes(ceid),
+		ciphertext, ecpToBytes(id.Nym), msg,
+	}, nil))
+	sr := amcl.Modadd(rt, amcl.Modmul(challenge, r, idemix.GroupOrder), idemix.GroupOrder)
+	sm := amcl.Modadd(mt, amcl.Modmul(challenge, mEid, idemix.GroupOrder), idemix.GroupOrder)
+
+	return &m.EnrollmentIDAudit{
+		C1:         ecpToBytes(c1),
+		Ceid:       ecpToBytes(ceid),
+		Ciphertext: ciphertext,
+		ProofC:     idemix.BigToBytes(challenge),
+		ProofSR:    idemix.BigToBytes(sr),
+		ProofSM:    idemix.BigToBytes(sm),
+	}, nil
+}
+
+// verifyEnrollmentIDAudit checks the Schnorr proof attached to an audit
+// record without decrypting it: it confirms that C1 and Ceid share the
+// same encryption randomness, and that Ceid commits to some value m via
+// HSk, but (as intended) cannot itself confirm that m is the enrolled
+// value - only AuditorDecrypt, which has the plaintext, can do that.
+func verifyEnrollmentIDAudit(ipk *idemix.IssuerPublicKey, audit *m.EnrollmentIDAudit, nym *amcl.ECP, msg []byte) error {
+	c1, err := bytesToECP(audit.C1)
+	if err != nil {
+		return errors.Wrap(err, "invalid audit ciphertext commitment")
+	}
+	ceid, err := bytesToECP(audit.Ceid)
+	if err != nil {
+		return errors.Wrap(err, "invalid audit attribute commitment")
+	}
+	proofC := amcl.FromBytes(audit.ProofC)
+	proofSR := amcl.FromBytes(audit.ProofSR)
+	proofSM := amcl.FromBytes(audit.ProofSM)
+	negC := amcl.ModNeg(proofC, idemix.GroupOrder)
+
+	// t1 = HRand^proofSR . C1^(-proofC)
+	t1 := ipk.HRand.Mul(proofSR)
+	t1.Add(c1.Mul(negC))
+
+	// t2 = HSk^proofSM . HRand^proofSR . Ceid^(-proofC)
+	t2 := ipk.HSk.Mul(proofSM)
+	t2.Add(ipk.HRand.Mul(proofSR))
+	t2.Add(ceid.Mul(negC))
+
+	recomputedC := idemix.HashModOrder(bytes.Join([][]byte{
+		ecpToBytes(t1), ecpToBytes(t2), audit.C1, audit.Ceid, audit.Ciphertext, ecpToBytes(nym), msg,
+	}, nil))
+	if !bytes.Equal(idemix.BigToBytes(recomputedC), audit.ProofC) {
+		return errors.Errorf("enrollment-id audit proof is invalid: challenge does not match")
+	}
+	return nil
+}
+
+// AuditorDecrypt recovers the plaintext enrollment ID bound to sig, using
+// the auditor's ElGamal secret key, and cross-checks it against the
+// signature's Ceid commitment so the returned value is cryptographically
+// guaranteed to be the same one the credential's eidIndex attribute
+// committed to, not merely whatever the signer chose to XOR into the
+// ciphertext. It assumes sig has already been found valid via
+// Identity.Verify; it does not itself re-check the idemix signature.
+func AuditorDecrypt(ipk *idemix.IssuerPublicKey, sig []byte, auditorSk *amcl.BIG) (string, error) {
+	wrapper := new(m.IdemixSignatureEnvelope)
+	if err := proto.Unmarshal(sig, wrapper); err != nil {
+		return "", errors.Wrap(err, "error unmarshalling idemix signature envelope")
+	}
+	if wrapper.Audit == nil {
+		return "", errors.Errorf("signature does not carry an enrollment-id audit record")
+	}
+
+	c1, err := bytesToECP(wrapper.Audit.C1)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid audit ciphertext commitment")
+	}
+	if _, err := bytesToECP(wrapper.Audit.Ceid); err != nil {
+		return "", errors.Wrap(err, "invalid audit attribute commitment")
+	}
+	shared := c1.Mul(auditorSk)
+	keyBytes := idemix.BigToBytes(idemix.HashModOrder(ecpToBytes(shared)))
+	eidBytes := xorBytes(keyBytes, wrapper.Audit.Ciphertext)
+
+	// Confirm Ceid == HSk^H(eidBytes) . C1, i.e. that the attribute
+	// committed to in Ceid is the hash of the plaintext we just decrypted.
+	mRecovered := idemix.HashModOrder(eidBytes)
+	expected := ipk.HSk.Mul(mRecovered)
+	expected.Add(c1)
+	if !bytes.Equal(ecpToBytes(expected), wrapper.Audit.Ceid) {
+		return "", errors.Errorf("decrypted enrollment id does not match the credential's committed attribute")
+	}
+
+	return string(eidBytes), nil
 }
 
 func (id *idemixSigningIdentity) GetPublicVersion() Identity {
 	return id.idemixidentity
 }
+
+// SignWithNym produces a lightweight signature that proves only knowledge of
+// the pseudonym's secret (sk, RandNym), without re-proving possession of a
+// CA-issued credential. It is a standard Schnorr-style proof of knowledge of
+// (sk, rNym) such that Nym = HSk^sk . HRand^rNym, bound to msg via
+// Fiat-Shamir. This is considerably cheaper than Sign and is intended for
+// high-volume intra-session signing once a peer has already verified a full
+// Idemix signature from the same pseudonym.
+func (id *idemixSigningIdentity) SignWithNym(msg []byte) ([]byte, error) {
+	mspLogger.Debugf("Idemix identity %s is signing with nym", id.GetIdentifier())
+
+	rSk := amcl.RandModOrder(id.rng)
+	rRNym := amcl.RandModOrder(id.rng)
+
+	// t = HSk^rSk . HRand^rRNym
+	t := id.msp.ipk.HSk.Mul(rSk)
+	t.Add(id.msp.ipk.HRand.Mul(rRNym))
+
+	nonce := idemix.BigToBytes(amcl.RandModOrder(id.rng))
+
+	proofData := bytes.Join([][]byte{
+		idemix.BigToBytes(t.GetX()),
+		idemix.BigToBytes(t.GetY()),
+		idemix.BigToBytes(id.Nym.GetX()),
+		idemix.BigToBytes(id.Nym.GetY()),
+		nonce,
+		msg,
+	}, nil)
+	proofC := idemix.HashModOrder(proofData)
+
+	proofSSk := amcl.Modadd(rSk, amcl.Modmul(proofC, id.Sk, idemix.GroupOrder), idemix.GroupOrder)
+	proofSRNym := amcl.Modadd(rRNym, amcl.Modmul(proofC, id.RandNym, idemix.GroupOrder), idemix.GroupOrder)
+
+	sig := &m.NymSignature{
+		ProofC:     idemix.BigToBytes(proofC),
+		ProofSSk:   idemix.BigToBytes(proofSSk),
+		ProofSRNym: idemix.BigToBytes(proofSRNym),
+		Nonce:      nonce,
+	}
+	return proto.Marshal(sig)
+}
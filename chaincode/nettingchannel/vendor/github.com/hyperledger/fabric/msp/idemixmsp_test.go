@@ -0,0 +1,511 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package msp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/idemix"
+	m "github.com/hyperledger/fabric/protos/msp"
+	amcl "github.com/manudrijvers/amcl/go"
+)
+
+// newSignedCRI builds a CredentialRevocationInformation for the given epoch
+// and revoked handles, signed with revocationSk, the way an issuer would
+// when publishing a fresh CRI.
+func newSignedCRI(t *testing.T, revocationSk *ecdsa.PrivateKey, epoch int64, revokedHandles [][]byte) *m.CredentialRevocationInformation {
+	t.Helper()
+	digest := criDigest(epoch, revokedHandles)
+	sig, err := ecdsa.SignASN1(rand.Reader, revocationSk, digest)
+	if err != nil {
+		t.Fatalf("failed to sign test CRI: %v", err)
+	}
+	return &m.CredentialRevocationInformation{
+		Epoch:          epoch,
+		RevokedHandles: revokedHandles,
+		EpochSignature: sig,
+	}
+}
+
+func TestSignWithNymVerifyNymSignature(t *testing.T) {
+	rng, err := idemix.GetRand()
+	if err != nil {
+		t.Fatalf("failed to get idemix rng: %v", err)
+	}
+
+	key, err := idemix.NewIssuerKey([]string{AttributeNameOU, AttributeNameRole, AttributeNameEnrollmentId, AttributeNameRevocationHandle}, rng)
+	if err != nil {
+		t.Fatalf("failed to generate issuer key: %v", err)
+	}
+
+	msp := &idemixmsp{name: "test-msp", ipk: key.Ipk, provider: NewIdemixProvider()}
+
+	sk := amcl.RandModOrder(rng)
+	Nym, RandNym, err := msp.provider.MakeNym(sk, msp.ipk, rng)
+	if err != nil {
+		t.Fatalf("MakeNym failed: %v", err)
+	}
+
+	role := &m.MSPRole{MspIdentifier: msp.name, Role: m.MSPRole_MEMBER}
+	ou := &m.OrganizationUnit{MspIdentifier: msp.name, OrganizationalUnitIdentifier: "org1"}
+	id := &idemixSigningIdentity{
+		idemixidentity: newIdemixIdentity(msp, Nym, role, ou),
+		rng:            rng,
+		Sk:             sk,
+		RandNym:        RandNym,
+	}
+
+	msg := []byte("hello world")
+	sig, err := id.SignWithNym(msg)
+	if err != nil {
+		t.Fatalf("SignWithNym failed: %v", err)
+	}
+
+	if err := id.VerifyNymSignature(msg, sig); err != nil {
+		t.Fatalf("VerifyNymSignature rejected a valid nym signature: %v", err)
+	}
+
+	if err := id.VerifyNymSignature([]byte("a different message"), sig); err == nil {
+		t.Fatalf("VerifyNymSignature accepted a nym signature over the wrong message")
+	}
+}
+
+func TestWalletPersistLoadRoundTrip(t *testing.T) {
+	rng, err := idemix.GetRand()
+	if err != nil {
+		t.Fatalf("failed to get idemix rng: %v", err)
+	}
+
+	attributeNames := []string{AttributeNameOU, AttributeNameRole, AttributeNameEnrollmentId, AttributeNameRevocationHandle}
+	key, err := idemix.NewIssuerKey(attributeNames, rng)
+	if err != nil {
+		t.Fatalf("failed to generate issuer key: %v", err)
+	}
+
+	msp := &idemixmsp{
+		name:           "test-msp",
+		ipk:            key.Ipk,
+		provider:       NewIdemixProvider(),
+		attributeNames: attributeNames,
+		wallet:         make(map[string]*idemixWalletEntry),
+	}
+
+	sk := amcl.RandModOrder(rng)
+	enrollmentID := "alice"
+	ou := &m.OrganizationUnit{MspIdentifier: msp.name, OrganizationalUnitIdentifier: "org1"}
+	role := &m.MSPRole{MspIdentifier: msp.name, Role: m.MSPRole_MEMBER}
+
+	ouBytes, err := proto.Marshal(ou)
+	if err != nil {
+		t.Fatalf("failed to marshal OU: %v", err)
+	}
+	roleBytes, err := proto.Marshal(role)
+	if err != nil {
+		t.Fatalf("failed to marshal Role: %v", err)
+	}
+
+	attrs := []*amcl.BIG{
+		idemix.HashModOrder(ouBytes),
+		idemix.HashModOrder(roleBytes),
+		idemix.HashModOrder([]byte(enrollmentID)),
+		amcl.RandModOrder(rng), // revocation handle
+	}
+
+	nonce := idemix.BigToBytes(amcl.RandModOrder(rng))
+	credRequest := idemix.NewCredRequest(sk, nonce, key.Ipk, rng)
+	cred, err := idemix.NewCredential(key, credRequest, attrs, rng)
+	if err != nil {
+		t.Fatalf("failed to issue test credential: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "idemix-wallet-test")
+	if err != nil {
+		t.Fatalf("failed to create temp wallet dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	msp.walletDir = dir
+
+	if err := msp.Import(&IdemixCredential{
+		Sk:                           sk,
+		Cred:                         cred,
+		OrganizationalUnitIdentifier: ou.OrganizationalUnitIdentifier,
+		EnrollmentID:                 enrollmentID,
+		Attrs:                        map[string]string{},
+	}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	ids := msp.List()
+	if len(ids) != 1 {
+		t.Fatalf("expected 1 wallet entry after import, got %d", len(ids))
+	}
+
+	reloaded := &idemixmsp{
+		name:           msp.name,
+		ipk:            key.Ipk,
+		rng:            rng,
+		provider:       NewIdemixProvider(),
+		attributeNames: attributeNames,
+		wallet:         make(map[string]*idemixWalletEntry),
+	}
+	if err := reloaded.LoadWallet(dir); err != nil {
+		t.Fatalf("LoadWallet failed: %v", err)
+	}
+
+	reloadedIDs := reloaded.List()
+	if len(reloadedIDs) != 1 {
+		t.Fatalf("expected 1 wallet entry after reload, got %d", len(reloadedIDs))
+	}
+	if reloadedIDs[0].Id != ids[0].Id {
+		t.Fatalf("reloaded wallet entry id %q does not match original %q", reloadedIDs[0].Id, ids[0].Id)
+	}
+
+	signingID, err := reloaded.GetSigningIdentity(reloadedIDs[0])
+	if err != nil {
+		t.Fatalf("GetSigningIdentity failed after reload: %v", err)
+	}
+	if signingID.(*idemixSigningIdentity).EnrollmentID != enrollmentID {
+		t.Fatalf("reloaded enrollment id %q does not match original %q", signingID.(*idemixSigningIdentity).EnrollmentID, enrollmentID)
+	}
+}
+
+func TestValidateRejectsStaleAndRevokedCRI(t *testing.T) {
+	rng, err := idemix.GetRand()
+	if err != nil {
+		t.Fatalf("failed to get idemix rng: %v", err)
+	}
+
+	attributeNames := []string{AttributeNameOU, AttributeNameRole, AttributeNameEnrollmentId, AttributeNameRevocationHandle}
+	key, err := idemix.NewIssuerKey(attributeNames, rng)
+	if err != nil {
+		t.Fatalf("failed to generate issuer key: %v", err)
+	}
+
+	revocationSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate revocation key: %v", err)
+	}
+
+	msp := &idemixmsp{
+		name:               "test-msp",
+		ipk:                key.Ipk,
+		provider:           NewIdemixProvider(),
+		attributeNames:     attributeNames,
+		revocationPK:       &revocationSk.PublicKey,
+		criFreshnessWindow: time.Hour,
+	}
+
+	sk := amcl.RandModOrder(rng)
+	role := &m.MSPRole{MspIdentifier: msp.name, Role: m.MSPRole_MEMBER}
+	ou := &m.OrganizationUnit{MspIdentifier: msp.name, OrganizationalUnitIdentifier: "org1"}
+	ouBytes, _ := proto.Marshal(ou)
+	roleBytes, _ := proto.Marshal(role)
+
+	revocationHandle := amcl.RandModOrder(rng)
+	attrs := []*amcl.BIG{
+		idemix.HashModOrder(ouBytes),
+		idemix.HashModOrder(roleBytes),
+		idemix.HashModOrder([]byte("alice")),
+		revocationHandle,
+	}
+	nonce := idemix.BigToBytes(amcl.RandModOrder(rng))
+	credRequest := idemix.NewCredRequest(sk, nonce, key.Ipk, rng)
+	cred, err := idemix.NewCredential(key, credRequest, attrs, rng)
+	if err != nil {
+		t.Fatalf("failed to issue test credential: %v", err)
+	}
+
+	Nym, RandNym, err := msp.provider.MakeNym(sk, msp.ipk, rng)
+	if err != nil {
+		t.Fatalf("MakeNym failed: %v", err)
+	}
+	signingID := &idemixSigningIdentity{
+		idemixidentity: newIdemixIdentity(msp, Nym, role, ou),
+		rng:            rng,
+		Cred:           cred,
+		Sk:             sk,
+		RandNym:        RandNym,
+	}
+
+	if err := msp.setCRI(newSignedCRI(t, revocationSk, time.Now().Unix(), nil)); err != nil {
+		t.Fatalf("setCRI rejected a validly signed, fresh CRI: %v", err)
+	}
+	if err := msp.Validate(signingID); err != nil {
+		t.Fatalf("Validate rejected an identity against a fresh, non-revoking CRI: %v", err)
+	}
+
+	staleEpoch := time.Now().Add(-2 * msp.criFreshnessWindow).Unix()
+	if err := msp.setCRI(newSignedCRI(t, revocationSk, staleEpoch, nil)); err != nil {
+		t.Fatalf("setCRI rejected a validly signed, stale CRI: %v", err)
+	}
+	if err := msp.Validate(signingID); err == nil {
+		t.Fatalf("Validate accepted an identity against a stale CRI")
+	}
+
+	if err := msp.setCRI(newSignedCRI(t, revocationSk, time.Now().Unix(), [][]byte{idemix.BigToBytes(revocationHandle)})); err != nil {
+		t.Fatalf("setCRI rejected a validly signed CRI revoking this handle: %v", err)
+	}
+	if err := msp.Validate(signingID); err == nil {
+		t.Fatalf("Validate accepted an identity whose revocation handle is in the current epoch's CRI")
+	}
+}
+
+func TestSignWithAuditorAuditorDecryptRecoversEnrollmentID(t *testing.T) {
+	rng, err := idemix.GetRand()
+	if err != nil {
+		t.Fatalf("failed to get idemix rng: %v", err)
+	}
+
+	attributeNames := []string{AttributeNameOU, AttributeNameRole, AttributeNameEnrollmentId, AttributeNameRevocationHandle}
+	key, err := idemix.NewIssuerKey(attributeNames, rng)
+	if err != nil {
+		t.Fatalf("failed to generate issuer key: %v", err)
+	}
+
+	revocationSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate revocation key: %v", err)
+	}
+	auditorSk := amcl.RandModOrder(rng)
+	auditorPK := key.Ipk.HRand.Mul(auditorSk)
+
+	msp := &idemixmsp{
+		name:               "test-msp",
+		ipk:                key.Ipk,
+		provider:           NewIdemixProvider(),
+		attributeNames:     attributeNames,
+		revocationPK:       &revocationSk.PublicKey,
+		criFreshnessWindow: time.Hour,
+		auditorPK:          auditorPK,
+	}
+	if err := msp.setCRI(newSignedCRI(t, revocationSk, time.Now().Unix(), nil)); err != nil {
+		t.Fatalf("setCRI failed: %v", err)
+	}
+
+	sk := amcl.RandModOrder(rng)
+	enrollmentID := "alice"
+	role := &m.MSPRole{MspIdentifier: msp.name, Role: m.MSPRole_MEMBER}
+	ou := &m.OrganizationUnit{MspIdentifier: msp.name, OrganizationalUnitIdentifier: "org1"}
+	ouBytes, _ := proto.Marshal(ou)
+	roleBytes, _ := proto.Marshal(role)
+
+	attrs := []*amcl.BIG{
+		idemix.HashModOrder(ouBytes),
+		idemix.HashModOrder(roleBytes),
+		idemix.HashModOrder([]byte(enrollmentID)),
+		amcl.RandModOrder(rng), // revocation handle
+	}
+	nonce := idemix.BigToBytes(amcl.RandModOrder(rng))
+	credRequest := idemix.NewCredRequest(sk, nonce, key.Ipk, rng)
+	cred, err := idemix.NewCredential(key, credRequest, attrs, rng)
+	if err != nil {
+		t.Fatalf("failed to issue test credential: %v", err)
+	}
+
+	Nym, RandNym, err := msp.provider.MakeNym(sk, msp.ipk, rng)
+	if err != nil {
+		t.Fatalf("MakeNym failed: %v", err)
+	}
+	signingID := &idemixSigningIdentity{
+		idemixidentity: newIdemixIdentity(msp, Nym, role, ou),
+		rng:            rng,
+		Cred:           cred,
+		Sk:             sk,
+		RandNym:        RandNym,
+		EnrollmentID:   enrollmentID,
+	}
+
+	msg := []byte("hello world")
+	sig, err := signingID.Sign(msg)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	recovered, err := AuditorDecrypt(key.Ipk, sig, auditorSk)
+	if err != nil {
+		t.Fatalf("AuditorDecrypt failed on a genuine audited signature: %v", err)
+	}
+	if recovered != enrollmentID {
+		t.Fatalf("AuditorDecrypt recovered %q, expected %q", recovered, enrollmentID)
+	}
+
+	envelope := new(m.IdemixSignatureEnvelope)
+	if err := proto.Unmarshal(sig, envelope); err != nil {
+		t.Fatalf("failed to unmarshal signature envelope: %v", err)
+	}
+	tampered := make([]byte, len(envelope.Audit.Ciphertext))
+	copy(tampered, envelope.Audit.Ciphertext)
+	tampered[0] ^= 0xFF
+	envelope.Audit.Ciphertext = tampered
+	tamperedSig, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("failed to re-marshal tampered envelope: %v", err)
+	}
+	if _, err := AuditorDecrypt(key.Ipk, tamperedSig, auditorSk); err == nil {
+		t.Fatalf("AuditorDecrypt accepted a tampered audit ciphertext")
+	}
+}
+
+func TestNewIdemixMspWithProviderWiresCustomProvider(t *testing.T) {
+	provider := NewPKCS11IdemixProvider(1, "test-token")
+
+	mspItf, err := NewIdemixMspWithProvider(provider)
+	if err != nil {
+		t.Fatalf("NewIdemixMspWithProvider failed: %v", err)
+	}
+	im, ok := mspItf.(*idemixmsp)
+	if !ok {
+		t.Fatalf("NewIdemixMspWithProvider returned unexpected type %T", mspItf)
+	}
+	if im.provider != provider {
+		t.Fatalf("NewIdemixMspWithProvider did not wire the supplied provider into the MSP")
+	}
+
+	if _, err := NewIdemixMspWithProvider(nil); err == nil {
+		t.Fatalf("NewIdemixMspWithProvider accepted a nil provider")
+	}
+
+	// The pkcs11 provider is not yet implemented: it must fail closed on
+	// every operation that would need to handle key material, rather than
+	// silently falling back to software key handling.
+	if _, _, err := provider.MakeNym(nil, nil, nil); err == nil {
+		t.Fatalf("pkcs11 provider's MakeNym did not fail closed")
+	}
+	if _, err := provider.NewSignature(nil, nil, nil, nil, nil, nil, nil, 0, nil, nil); err == nil {
+		t.Fatalf("pkcs11 provider's NewSignature did not fail closed")
+	}
+	if err := provider.VerifyCredential(nil, nil, nil); err == nil {
+		t.Fatalf("pkcs11 provider's VerifyCredential did not fail closed")
+	}
+}
+
+func TestSignWithDisclosureSatisfiesIdemixAttributePrincipal(t *testing.T) {
+	rng, err := idemix.GetRand()
+	if err != nil {
+		t.Fatalf("failed to get idemix rng: %v", err)
+	}
+
+	attributeNames := []string{AttributeNameOU, AttributeNameRole, AttributeNameEnrollmentId, AttributeNameRevocationHandle, "Department"}
+	key, err := idemix.NewIssuerKey(attributeNames, rng)
+	if err != nil {
+		t.Fatalf("failed to generate issuer key: %v", err)
+	}
+
+	revocationSk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate revocation key: %v", err)
+	}
+
+	msp := &idemixmsp{
+		name:               "test-msp",
+		ipk:                key.Ipk,
+		provider:           NewIdemixProvider(),
+		attributeNames:     attributeNames,
+		revocationPK:       &revocationSk.PublicKey,
+		criFreshnessWindow: time.Hour,
+	}
+	if err := msp.setCRI(newSignedCRI(t, revocationSk, time.Now().Unix(), nil)); err != nil {
+		t.Fatalf("setCRI failed: %v", err)
+	}
+
+	newIdentity := func(enrollmentID, department string) *idemixSigningIdentity {
+		sk := amcl.RandModOrder(rng)
+		role := &m.MSPRole{MspIdentifier: msp.name, Role: m.MSPRole_MEMBER}
+		ou := &m.OrganizationUnit{MspIdentifier: msp.name, OrganizationalUnitIdentifier: "org1"}
+		ouBytes, _ := proto.Marshal(ou)
+		roleBytes, _ := proto.Marshal(role)
+
+		attrs := []*amcl.BIG{
+			idemix.HashModOrder(ouBytes),
+			idemix.HashModOrder(roleBytes),
+			idemix.HashModOrder([]byte(enrollmentID)),
+			amcl.RandModOrder(rng), // revocation handle
+			idemix.HashModOrder([]byte(department)),
+		}
+		nonce := idemix.BigToBytes(amcl.RandModOrder(rng))
+		credRequest := idemix.NewCredRequest(sk, nonce, key.Ipk, rng)
+		cred, err := idemix.NewCredential(key, credRequest, attrs, rng)
+		if err != nil {
+			t.Fatalf("failed to issue test credential: %v", err)
+		}
+		Nym, RandNym, err := msp.provider.MakeNym(sk, msp.ipk, rng)
+		if err != nil {
+			t.Fatalf("MakeNym failed: %v", err)
+		}
+		return &idemixSigningIdentity{
+			idemixidentity: newIdemixIdentity(msp, Nym, role, ou),
+			rng:            rng,
+			Cred:           cred,
+			Sk:             sk,
+			RandNym:        RandNym,
+			EnrollmentID:   enrollmentID,
+			Attrs:          map[string]string{"Department": department},
+		}
+	}
+
+	alice := newIdentity("alice", "engineering")
+	bob := newIdentity("bob", "sales")
+
+	aliceMsg := []byte("alice's transaction")
+	aliceSig, err := alice.SignWithDisclosure(aliceMsg, []string{"Department"})
+	if err != nil {
+		t.Fatalf("alice's SignWithDisclosure failed: %v", err)
+	}
+	bobMsg := []byte("bob's transaction")
+	bobSig, err := bob.SignWithDisclosure(bobMsg, []string{"Department"})
+	if err != nil {
+		t.Fatalf("bob's SignWithDisclosure failed: %v", err)
+	}
+
+	alicePub := alice.GetPublicVersion().(*idemixidentity)
+	bobPub := bob.GetPublicVersion().(*idemixidentity)
+
+	aliceDisclosed, err := alicePub.VerifyWithAttributes(aliceMsg, aliceSig)
+	if err != nil {
+		t.Fatalf("VerifyWithAttributes failed on alice's signature: %v", err)
+	}
+	bobDisclosed, err := bobPub.VerifyWithAttributes(bobMsg, bobSig)
+	if err != nil {
+		t.Fatalf("VerifyWithAttributes failed on bob's signature: %v", err)
+	}
+
+	engineeringPrincipal := &m.MSPPrincipal{
+		PrincipalClassification: m.MSPPrincipal_IDEMIX_ATTRIBUTE,
+	}
+	attrBytes, err := proto.Marshal(&m.MSPIdemixAttribute{AttributeName: "Department", AttributeValue: "engineering"})
+	if err != nil {
+		t.Fatalf("failed to marshal MSPIdemixAttribute: %v", err)
+	}
+	engineeringPrincipal.Principal = attrBytes
+
+	if err := msp.SatisfiesPrincipalWithAttributes(alicePub, engineeringPrincipal, aliceDisclosed); err != nil {
+		t.Fatalf("alice should satisfy the engineering-department principal: %v", err)
+	}
+	// bob's own disclosure (sales) must not satisfy a principal checked
+	// against it that demands engineering - and, critically, aliceDisclosed
+	// must not leak into bob's check or vice versa.
+	if err := msp.SatisfiesPrincipalWithAttributes(bobPub, engineeringPrincipal, bobDisclosed); err == nil {
+		t.Fatalf("bob should not satisfy the engineering-department principal")
+	}
+	if err := msp.SatisfiesPrincipalWithAttributes(bobPub, engineeringPrincipal, aliceDisclosed); err == nil {
+		t.Fatalf("SatisfiesPrincipalWithAttributes must not accept alice's disclosures when checking bob's identity")
+	}
+
+	// The plain SatisfiesPrincipal has no cached state to fall back on and
+	// must refuse to evaluate an IDEMIX_ATTRIBUTE principal at all, rather
+	// than silently using stale or wrong data.
+	if err := msp.SatisfiesPrincipal(alicePub, engineeringPrincipal); err == nil {
+		t.Fatalf("SatisfiesPrincipal should not be able to evaluate an IDEMIX_ATTRIBUTE principal")
+	}
+}